@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2019 The ontology Authors
+ * This file is part of The ontology library.
+ *
+ * The ontology is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The ontology is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The ontology.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package shardmgmt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ontio/ontology/common"
+	cstates "github.com/ontio/ontology/core/states"
+	"github.com/ontio/ontology/smartcontract/service/native"
+	"github.com/ontio/ontology/smartcontract/service/native/utils"
+)
+
+const KEY_ADMIN = "admin"
+
+func getAdmin(native *native.NativeService, contract common.Address) (common.Address, error) {
+	data, err := native.CacheDB.Get(utils.ConcatKey(contract, []byte(KEY_ADMIN)))
+	if err != nil {
+		return common.Address{}, fmt.Errorf("getAdmin: read db failed, err: %s", err)
+	}
+	if len(data) == 0 {
+		return common.Address{}, nil
+	}
+	value, err := cstates.GetValueFromRawStorageItem(data)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("getAdmin: deserialize from raw storage: %s", err)
+	}
+	admin := common.Address{}
+	if err := admin.Deserialize(bytes.NewBuffer(value)); err != nil {
+		return common.Address{}, fmt.Errorf("getAdmin: deserialize admin address: %s", err)
+	}
+	return admin, nil
+}
+
+func setAdmin(native *native.NativeService, contract common.Address, admin common.Address) error {
+	buf := new(bytes.Buffer)
+	if err := admin.Serialize(buf); err != nil {
+		return fmt.Errorf("setAdmin: serialize admin address: %s", err)
+	}
+	native.CacheDB.Put(utils.ConcatKey(contract, []byte(KEY_ADMIN)), cstates.GenRawStorageItem(buf.Bytes()))
+	return nil
+}
+
+// checkAdminWitness requires the current invocation to be witnessed by the configured
+// shard-mgmt admin, so governance-only entry points (peer-usage cap configuration,
+// forced settlement, ...) cannot be invoked by an arbitrary caller. It fails closed:
+// until ShardMgmtInitAdmin has been called once, every admin-gated entry point is
+// refused rather than left open to whoever calls first.
+func checkAdminWitness(native *native.NativeService, contract common.Address) error {
+	admin, err := getAdmin(native, contract)
+	if err != nil {
+		return err
+	}
+	if admin == (common.Address{}) {
+		return fmt.Errorf("checkAdminWitness: shard mgmt admin has not been configured, call ShardMgmtInitAdmin first")
+	}
+	if !native.ContextRef.CheckWitness(admin) {
+		return fmt.Errorf("checkAdminWitness: caller is not the shard mgmt admin")
+	}
+	return nil
+}
+
+// InitAdminParam is the native-method parameter for ShardMgmtInitAdmin.
+type InitAdminParam struct {
+	Admin common.Address
+}
+
+func (this *InitAdminParam) Serialize(w io.Writer) error {
+	return this.Admin.Serialize(w)
+}
+
+func (this *InitAdminParam) Deserialize(r io.Reader) error {
+	return this.Admin.Deserialize(r)
+}
+
+// ShardMgmtInitAdmin configures the shard-mgmt admin address. The first call, when no
+// admin is configured yet, is unguarded so the contract can be bootstrapped; every
+// call after that must be witnessed by the current admin, so ownership can be handed
+// off deliberately but never hijacked by a second, unrelated caller.
+func ShardMgmtInitAdmin(native *native.NativeService) ([]byte, error) {
+	param := &InitAdminParam{}
+	if err := param.Deserialize(bytes.NewBuffer(native.Input)); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtInitAdmin: invalid param: %s", err)
+	}
+
+	contract := native.ContextRef.CurrentContext().ContractAddress
+	current, err := getAdmin(native, contract)
+	if err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtInitAdmin: %s", err)
+	}
+	if current != (common.Address{}) && !native.ContextRef.CheckWitness(current) {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtInitAdmin: caller is not the current shard mgmt admin")
+	}
+
+	if err := setAdmin(native, contract, param.Admin); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtInitAdmin: %s", err)
+	}
+	return utils.BYTE_TRUE, nil
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (C) 2019 The ontology Authors
+ * This file is part of The ontology library.
+ *
+ * The ontology is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The ontology is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The ontology.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package shardmgmt
+
+import (
+	"fmt"
+
+	"github.com/ontio/ontology/common/log"
+	"github.com/ontio/ontology/smartcontract/service/native"
+	"github.com/ontio/ontology/smartcontract/service/native/shardmgmt/states"
+	"github.com/ontio/ontology/smartcontract/service/native/utils"
+)
+
+// ShardMgmtInit is the native-contract entry point invoked once per deployment or
+// version bump, before any other shard-mgmt method runs. On a fresh deployment (no
+// version stored yet) it writes the initial global state and the current version.
+// On an upgrade (a stored version behind VERSION_CONTRACT_SHARD_MGMT) it instead runs
+// MigrateShardMgmtState, so every already-persisted global/shard/peer-state entry is
+// carried forward through the registered migrator chain before anything else reads
+// it - without this call, the migrator chain registered via RegisterMigrator never
+// actually runs against real stored state.
+func ShardMgmtInit(native *native.NativeService) ([]byte, error) {
+	contract := native.ContextRef.CurrentContext().ContractAddress
+
+	fromVer, err := getVersion(native, contract)
+	if err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtInit: %s", err)
+	}
+
+	if fromVer == 0 {
+		if err := setGlobalState(native, contract, &shardstates.ShardMgmtGlobalState{}); err != nil {
+			return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtInit: %s", err)
+		}
+		if err := setVersion(native, contract); err != nil {
+			return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtInit: %s", err)
+		}
+		log.Infof("shardmgmt: initialized at version %d", VERSION_CONTRACT_SHARD_MGMT)
+		return utils.BYTE_TRUE, nil
+	}
+
+	if err := MigrateShardMgmtState(native, contract); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtInit: %s", err)
+	}
+	return utils.BYTE_TRUE, nil
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2019 The ontology Authors
+ * This file is part of The ontology library.
+ *
+ * The ontology is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The ontology is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The ontology.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package shardmgmt
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ontio/ontology/common"
+	"github.com/ontio/ontology/common/log"
+	cstates "github.com/ontio/ontology/core/states"
+	"github.com/ontio/ontology/core/types"
+	"github.com/ontio/ontology/smartcontract/service/native"
+	"github.com/ontio/ontology/smartcontract/service/native/shardmgmt/states"
+	"github.com/ontio/ontology/smartcontract/service/native/utils"
+)
+
+// EVENT_SHARD_MIGRATE identifies a migration audit event in ShardEventState.EventType,
+// alongside the other shard-mgmt event types (shard create/join/activate/...).
+const EVENT_SHARD_MIGRATE uint32 = 100
+
+// Migrator rewrites a single raw storage blob from one version to the next. It must
+// be able to deserialize the blob using the struct layout of `from` and serialize it
+// back using the struct layout of `to`.
+type Migrator func(raw []byte) ([]byte, error)
+
+// migrators is keyed by the version a blob is currently in; each entry migrates one
+// step forward. Chains of migrators are walked until the target version is reached.
+var migrators = map[uint32]Migrator{}
+
+// RegisterMigrator registers a migration step from `from` to `to`. `to` must be
+// `from`+1 so runMigrationChain can walk the chain one version at a time.
+func RegisterMigrator(from, to uint32, migrate Migrator) {
+	if to != from+1 {
+		panic(fmt.Sprintf("RegisterMigrator: non-contiguous migration %d -> %d", from, to))
+	}
+	migrators[from] = migrate
+}
+
+// MigrateShardMgmtState is invoked by Init when the stored version is behind
+// VERSION_CONTRACT_SHARD_MGMT. It walks every persisted global/shard/peer state entry
+// through the registered migrator chain and rewrites it in place, then bumps the
+// stored version. All writes go through native.CacheDB, so if the top-level native
+// invocation fails after this runs, the migration is rolled back along with it.
+//
+// Peer-state keys are scoped per shard (contract || shardCoord || KEY_SHARD_PEER_STATE
+// || pubkey), unlike global/shard state which sit directly under contract, so they
+// cannot be swept with one flat prefix. Instead this walks KEY_SHARD_STATE first,
+// collecting the coordinate of every known shard as it migrates each ShardState blob,
+// then sweeps KEY_SHARD_PEER_STATE once per collected coordinate.
+func MigrateShardMgmtState(native *native.NativeService, contract common.Address) error {
+	fromVer, err := getVersion(native, contract)
+	if err != nil {
+		return fmt.Errorf("MigrateShardMgmtState: %s", err)
+	}
+	if fromVer >= VERSION_CONTRACT_SHARD_MGMT {
+		return nil
+	}
+
+	if err := migratePrefix(native, contract, utils.ConcatKey(contract, []byte(KEY_GLOBAL_STATE)), types.ShardID{}, fromVer); err != nil {
+		return fmt.Errorf("MigrateShardMgmtState: %s", err)
+	}
+
+	shards, err := migrateShardStatePrefix(native, contract, fromVer)
+	if err != nil {
+		return fmt.Errorf("MigrateShardMgmtState: %s", err)
+	}
+
+	for _, shardID := range shards {
+		peerPrefix := utils.ConcatKey(contract, shardCoordOf(shardID).Bytes(), []byte(KEY_SHARD_PEER_STATE))
+		if err := migratePrefix(native, contract, peerPrefix, shardID, fromVer); err != nil {
+			return fmt.Errorf("MigrateShardMgmtState: %s", err)
+		}
+	}
+
+	if err := setVersion(native, contract); err != nil {
+		return fmt.Errorf("MigrateShardMgmtState: %s", err)
+	}
+	log.Infof("shardmgmt: migrated state from version %d to %d", fromVer, VERSION_CONTRACT_SHARD_MGMT)
+	return nil
+}
+
+// migratePrefix rewrites every entry under prefix through the migrator chain and
+// emits an audit event per entry, tagged with shardID (the zero value for prefixes
+// that aren't scoped to a single shard, e.g. KEY_GLOBAL_STATE).
+func migratePrefix(native *native.NativeService, contract common.Address, prefix []byte, shardID types.ShardID, fromVer uint32) error {
+	iter := native.CacheDB.NewIterator(prefix)
+	defer iter.Release()
+
+	for has := iter.First(); has; has = iter.Next() {
+		key := append([]byte{}, iter.Key()...)
+		value, err := cstates.GetValueFromRawStorageItem(iter.Value())
+		if err != nil {
+			return fmt.Errorf("deserialize raw storage item at key %x: %s", key, err)
+		}
+
+		migrated, err := runMigrationChain(value, fromVer, VERSION_CONTRACT_SHARD_MGMT)
+		if err != nil {
+			return fmt.Errorf("migrate key %x: %s", key, err)
+		}
+
+		native.CacheDB.Put(key, cstates.GenRawStorageItem(migrated))
+		if err := AddNotification(native, contract, &migrateShardEvent{
+			fromVersion: fromVer,
+			toVersion:   VERSION_CONTRACT_SHARD_MGMT,
+			shardID:     shardID,
+			height:      native.Height,
+		}); err != nil {
+			return fmt.Errorf("notify key %x: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// migrateShardStatePrefix migrates every entry under KEY_SHARD_STATE and returns the
+// ShardID of every shard it found, so the caller can locate that shard's peer-state
+// entries afterward.
+func migrateShardStatePrefix(native *native.NativeService, contract common.Address, fromVer uint32) ([]types.ShardID, error) {
+	prefix := utils.ConcatKey(contract, []byte(KEY_SHARD_STATE))
+	iter := native.CacheDB.NewIterator(prefix)
+	defer iter.Release()
+
+	var shardIDs []types.ShardID
+	for has := iter.First(); has; has = iter.Next() {
+		key := append([]byte{}, iter.Key()...)
+		value, err := cstates.GetValueFromRawStorageItem(iter.Value())
+		if err != nil {
+			return nil, fmt.Errorf("deserialize raw storage item at key %x: %s", key, err)
+		}
+
+		migrated, err := runMigrationChain(value, fromVer, VERSION_CONTRACT_SHARD_MGMT)
+		if err != nil {
+			return nil, fmt.Errorf("migrate key %x: %s", key, err)
+		}
+
+		var shardID types.ShardID
+		state := &shardstates.ShardState{}
+		if err := state.Deserialize(bytes.NewBuffer(migrated)); err == nil {
+			shardID = state.ShardID
+		}
+
+		native.CacheDB.Put(key, cstates.GenRawStorageItem(migrated))
+		if err := AddNotification(native, contract, &migrateShardEvent{
+			fromVersion: fromVer,
+			toVersion:   VERSION_CONTRACT_SHARD_MGMT,
+			shardID:     shardID,
+			height:      native.Height,
+		}); err != nil {
+			return nil, fmt.Errorf("notify key %x: %s", key, err)
+		}
+
+		shardIDs = append(shardIDs, shardID)
+	}
+	return shardIDs, nil
+}
+
+// runMigrationChain walks `raw` through every registered migrator between `from` and
+// `to`, returning the final blob.
+func runMigrationChain(raw []byte, from, to uint32) ([]byte, error) {
+	cur := raw
+	for v := from; v < to; v++ {
+		migrate, ok := migrators[v]
+		if !ok {
+			return nil, fmt.Errorf("no migrator registered for version %d", v)
+		}
+		next, err := migrate(cur)
+		if err != nil {
+			return nil, fmt.Errorf("migrator %d -> %d: %s", v, v+1, err)
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// migrateShardEvent implements shardstates.ShardMgmtEvent so a migration run can be
+// audited the same way as any other shard-mgmt state change. shardID is the zero
+// value for the global-state entry, which isn't attributable to a single shard;
+// shard-state and peer-state entries carry the ID of the shard they belong to.
+type migrateShardEvent struct {
+	fromVersion uint32
+	toVersion   uint32
+	shardID     types.ShardID
+	height      uint32
+}
+
+func (evt *migrateShardEvent) GetType() uint32 { return EVENT_SHARD_MIGRATE }
+func (evt *migrateShardEvent) GetHeight() uint32 { return evt.height }
+func (evt *migrateShardEvent) GetTargetShardID() types.ShardID { return evt.shardID }
@@ -0,0 +1,79 @@
+/*
+ * Copyright (C) 2019 The ontology Authors
+ * This file is part of The ontology library.
+ *
+ * The ontology is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The ontology is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The ontology.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package shardmgmt
+
+import "testing"
+
+func TestRunMigrationChainWalksEveryStep(t *testing.T) {
+	saved := migrators
+	defer func() { migrators = saved }()
+	migrators = map[uint32]Migrator{}
+
+	RegisterMigrator(1, 2, func(raw []byte) ([]byte, error) {
+		return append(raw, 'a'), nil
+	})
+	RegisterMigrator(2, 3, func(raw []byte) ([]byte, error) {
+		return append(raw, 'b'), nil
+	})
+
+	got, err := runMigrationChain([]byte{}, 1, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(got) != "ab" {
+		t.Fatalf("expected \"ab\", got %q", got)
+	}
+}
+
+func TestRunMigrationChainMissingMigratorErrors(t *testing.T) {
+	saved := migrators
+	defer func() { migrators = saved }()
+	migrators = map[uint32]Migrator{}
+
+	if _, err := runMigrationChain([]byte{}, 1, 2); err == nil {
+		t.Fatalf("expected error for unregistered migration step")
+	}
+}
+
+func TestRunMigrationChainNoopWhenAlreadyCurrent(t *testing.T) {
+	saved := migrators
+	defer func() { migrators = saved }()
+	migrators = map[uint32]Migrator{}
+
+	got, err := runMigrationChain([]byte("unchanged"), 3, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(got) != "unchanged" {
+		t.Fatalf("expected passthrough, got %q", got)
+	}
+}
+
+func TestRegisterMigratorRejectsNonContiguousVersions(t *testing.T) {
+	saved := migrators
+	defer func() { migrators = saved }()
+	migrators = map[uint32]Migrator{}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected panic for non-contiguous migrator registration")
+		}
+	}()
+	RegisterMigrator(1, 3, func(raw []byte) ([]byte, error) { return raw, nil })
+}
@@ -0,0 +1,386 @@
+/*
+ * Copyright (C) 2019 The ontology Authors
+ * This file is part of The ontology library.
+ *
+ * The ontology is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The ontology is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The ontology.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package shardmgmt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/ontio/ontology-crypto/keypair"
+	"github.com/ontio/ontology-crypto/signature"
+	"github.com/ontio/ontology/common"
+	"github.com/ontio/ontology/common/serialization"
+	cstates "github.com/ontio/ontology/core/states"
+	"github.com/ontio/ontology/core/types"
+	"github.com/ontio/ontology/smartcontract/service/native"
+	"github.com/ontio/ontology/smartcontract/service/native/utils"
+)
+
+const (
+	KEY_SHARD_PEER_ATTESTATION = "peerAttestation"
+	KEY_SHARD_PEER_NONCES      = "peerNonces"
+
+	// nonceRingSize bounds how many recently-seen nonces are kept per peer for replay
+	// rejection; older nonces simply fall off the ring.
+	nonceRingSize = 32
+)
+
+// PeerAttestation records the most recent signed proof that a peer consented to a
+// shard-membership transition, for later governance audit.
+type PeerAttestation struct {
+	Nonce  uint64
+	Sig    []byte
+	Height uint32
+}
+
+func (this *PeerAttestation) Serialize(w io.Writer) error {
+	if err := serialization.WriteUint64(w, this.Nonce); err != nil {
+		return fmt.Errorf("PeerAttestation.Serialize: nonce: %s", err)
+	}
+	if err := serialization.WriteVarBytes(w, this.Sig); err != nil {
+		return fmt.Errorf("PeerAttestation.Serialize: sig: %s", err)
+	}
+	return serialization.WriteUint32(w, this.Height)
+}
+
+func (this *PeerAttestation) Deserialize(r io.Reader) error {
+	var err error
+	if this.Nonce, err = serialization.ReadUint64(r); err != nil {
+		return fmt.Errorf("PeerAttestation.Deserialize: nonce: %s", err)
+	}
+	if this.Sig, err = serialization.ReadVarBytes(r); err != nil {
+		return fmt.Errorf("PeerAttestation.Deserialize: sig: %s", err)
+	}
+	if this.Height, err = serialization.ReadUint32(r); err != nil {
+		return fmt.Errorf("PeerAttestation.Deserialize: height: %s", err)
+	}
+	return nil
+}
+
+func genPeerAttestationKey(contract common.Address, shardCoordBytes []byte, pubKey keypair.PublicKey) []byte {
+	return utils.ConcatKey(contract, shardCoordBytes, []byte(KEY_SHARD_PEER_ATTESTATION), keypair.SerializePublicKey(pubKey))
+}
+
+func genPeerNonceRingKey(contract common.Address, shardCoordBytes []byte, pubKey keypair.PublicKey) []byte {
+	return utils.ConcatKey(contract, shardCoordBytes, []byte(KEY_SHARD_PEER_NONCES), keypair.SerializePublicKey(pubKey))
+}
+
+// GetLatestPeerAttestation returns the most recent join/leave attestation a peer
+// signed for shardID, or nil if the peer has never attested.
+func GetLatestPeerAttestation(native *native.NativeService, contract common.Address, shardID types.ShardID, pubKey keypair.PublicKey) (*PeerAttestation, error) {
+	key := genPeerAttestationKey(contract, shardCoordOf(shardID).Bytes(), pubKey)
+	data, err := native.CacheDB.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("GetLatestPeerAttestation: read db failed, err: %s", err)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	value, err := cstates.GetValueFromRawStorageItem(data)
+	if err != nil {
+		return nil, fmt.Errorf("GetLatestPeerAttestation: deserialize from raw storage: %s", err)
+	}
+	attestation := &PeerAttestation{}
+	if err := attestation.Deserialize(bytes.NewBuffer(value)); err != nil {
+		return nil, fmt.Errorf("GetLatestPeerAttestation: deserialize PeerAttestation: %s", err)
+	}
+	return attestation, nil
+}
+
+func setPeerAttestation(native *native.NativeService, contract common.Address, shardID types.ShardID, pubKey keypair.PublicKey, attestation *PeerAttestation) error {
+	buf := new(bytes.Buffer)
+	if err := attestation.Serialize(buf); err != nil {
+		return fmt.Errorf("setPeerAttestation: serialize PeerAttestation: %s", err)
+	}
+	key := genPeerAttestationKey(contract, shardCoordOf(shardID).Bytes(), pubKey)
+	native.CacheDB.Put(key, cstates.GenRawStorageItem(buf.Bytes()))
+	return nil
+}
+
+// checkAndRecordNonce rejects a nonce the peer has already used (replay protection),
+// otherwise records it in the peer's ring, evicting the oldest entry once the ring
+// is full.
+func checkAndRecordNonce(native *native.NativeService, contract common.Address, shardID types.ShardID, pubKey keypair.PublicKey, nonce uint64) error {
+	key := genPeerNonceRingKey(contract, shardCoordOf(shardID).Bytes(), pubKey)
+	data, err := native.CacheDB.Get(key)
+	if err != nil {
+		return fmt.Errorf("checkAndRecordNonce: read db failed, err: %s", err)
+	}
+
+	var nonces []uint64
+	if len(data) != 0 {
+		value, err := cstates.GetValueFromRawStorageItem(data)
+		if err != nil {
+			return fmt.Errorf("checkAndRecordNonce: deserialize from raw storage: %s", err)
+		}
+		buf := bytes.NewBuffer(value)
+		count, err := serialization.ReadUint32(buf)
+		if err != nil {
+			return fmt.Errorf("checkAndRecordNonce: deserialize nonce count: %s", err)
+		}
+		for i := uint32(0); i < count; i++ {
+			n, err := serialization.ReadUint64(buf)
+			if err != nil {
+				return fmt.Errorf("checkAndRecordNonce: deserialize nonce: %s", err)
+			}
+			if n == nonce {
+				return fmt.Errorf("checkAndRecordNonce: nonce %d already used", nonce)
+			}
+			nonces = append(nonces, n)
+		}
+	}
+
+	nonces = append(nonces, nonce)
+	if len(nonces) > nonceRingSize {
+		nonces = nonces[len(nonces)-nonceRingSize:]
+	}
+
+	buf := new(bytes.Buffer)
+	if err := serialization.WriteUint32(buf, uint32(len(nonces))); err != nil {
+		return fmt.Errorf("checkAndRecordNonce: serialize nonce count: %s", err)
+	}
+	for _, n := range nonces {
+		if err := serialization.WriteUint64(buf, n); err != nil {
+			return fmt.Errorf("checkAndRecordNonce: serialize nonce: %s", err)
+		}
+	}
+	native.CacheDB.Put(key, cstates.GenRawStorageItem(buf.Bytes()))
+	return nil
+}
+
+// allowedPeerAttestedTransitions whitelists the transitions a peer may self-attest.
+// Only the legs where the peer itself is the one consenting are listed: applying to
+// join, confirming a join once governance has approved it, and voluntarily leaving.
+// Everything else - in particular applied -> approved, which is governance's decision
+// to make, not the peer's - is deliberately absent, so AttestPeerTransition can never
+// be used to bypass the governance apply/approve gate.
+var allowedPeerAttestedTransitions = map[peerState]peerState{
+	state_default:  state_applied,
+	state_approved: state_joined,
+	state_joined:   state_default,
+}
+
+// isKnownPeerState reports whether state is one of the peerState enum values this
+// package understands, rejecting arbitrary caller-supplied strings.
+func isKnownPeerState(state peerState) bool {
+	switch state {
+	case state_default, state_applied, state_approved, state_joined, state_throttled:
+		return true
+	default:
+		return false
+	}
+}
+
+// AttestPeerTransitionParam is the native-method parameter for AttestPeerTransition.
+type AttestPeerTransitionParam struct {
+	ShardID   types.ShardID
+	FromState string
+	ToState   string
+	PubKey    string
+	Nonce     uint64
+	Sig       []byte
+}
+
+func (this *AttestPeerTransitionParam) Serialize(w io.Writer) error {
+	if err := this.ShardID.Serialize(w); err != nil {
+		return fmt.Errorf("AttestPeerTransitionParam.Serialize: shardID: %s", err)
+	}
+	if err := serialization.WriteString(w, this.FromState); err != nil {
+		return fmt.Errorf("AttestPeerTransitionParam.Serialize: fromState: %s", err)
+	}
+	if err := serialization.WriteString(w, this.ToState); err != nil {
+		return fmt.Errorf("AttestPeerTransitionParam.Serialize: toState: %s", err)
+	}
+	if err := serialization.WriteString(w, this.PubKey); err != nil {
+		return fmt.Errorf("AttestPeerTransitionParam.Serialize: pubKey: %s", err)
+	}
+	if err := serialization.WriteUint64(w, this.Nonce); err != nil {
+		return fmt.Errorf("AttestPeerTransitionParam.Serialize: nonce: %s", err)
+	}
+	return serialization.WriteVarBytes(w, this.Sig)
+}
+
+func (this *AttestPeerTransitionParam) Deserialize(r io.Reader) error {
+	if err := this.ShardID.Deserialize(r); err != nil {
+		return fmt.Errorf("AttestPeerTransitionParam.Deserialize: shardID: %s", err)
+	}
+	var err error
+	if this.FromState, err = serialization.ReadString(r); err != nil {
+		return fmt.Errorf("AttestPeerTransitionParam.Deserialize: fromState: %s", err)
+	}
+	if this.ToState, err = serialization.ReadString(r); err != nil {
+		return fmt.Errorf("AttestPeerTransitionParam.Deserialize: toState: %s", err)
+	}
+	if this.PubKey, err = serialization.ReadString(r); err != nil {
+		return fmt.Errorf("AttestPeerTransitionParam.Deserialize: pubKey: %s", err)
+	}
+	if this.Nonce, err = serialization.ReadUint64(r); err != nil {
+		return fmt.Errorf("AttestPeerTransitionParam.Deserialize: nonce: %s", err)
+	}
+	if this.Sig, err = serialization.ReadVarBytes(r); err != nil {
+		return fmt.Errorf("AttestPeerTransitionParam.Deserialize: sig: %s", err)
+	}
+	return nil
+}
+
+// AttestPeerTransition requires the peer identified by pubKey to prove it actively
+// consented to a shard-membership transition: it must sign
+// hash(shardID || fromState || toState || nonce || contract) with the private key
+// matching pubKey. Only the peer-initiated legs in allowedPeerAttestedTransitions are
+// accepted - this is not a replacement for the governance apply/approve gate, it is
+// layered on top of it, so a peer can never self-promote past a state that only
+// governance may grant. The signature is verified before anything is persisted; only
+// once it checks out is the nonce recorded, the new state written via
+// setShardPeerState, and the attestation stored under KEY_SHARD_PEER_ATTESTATION for
+// later governance audit.
+func AttestPeerTransition(native *native.NativeService, contract common.Address, shardID types.ShardID, fromState, toState peerState, pubKeyHex string, nonce uint64, sig []byte) error {
+	if !isKnownPeerState(toState) {
+		return fmt.Errorf("AttestPeerTransition: unknown target state %q", toState)
+	}
+	if allowedPeerAttestedTransitions[fromState] != toState {
+		return fmt.Errorf("AttestPeerTransition: peer-attested transition %s -> %s is not permitted", fromState, toState)
+	}
+
+	pubKeyData, err := hex.DecodeString(pubKeyHex)
+	if err != nil {
+		return fmt.Errorf("AttestPeerTransition: decode pub key failed, err: %s", err)
+	}
+	pubKey, err := keypair.DeserializePublicKey(pubKeyData)
+	if err != nil {
+		return fmt.Errorf("AttestPeerTransition: deserialize pub key failed, err: %s", err)
+	}
+
+	current, err := getShardPeerState(native, contract, shardID, pubKeyHex)
+	if err != nil {
+		return fmt.Errorf("AttestPeerTransition: %s", err)
+	}
+	if current != fromState {
+		return fmt.Errorf("AttestPeerTransition: peer is in state %s, not %s", current, fromState)
+	}
+
+	msg := attestationMessage(shardID, fromState, toState, nonce, contract)
+	if err := signature.Verify(pubKey, msg, sig); err != nil {
+		return fmt.Errorf("AttestPeerTransition: signature verification failed: %s", err)
+	}
+
+	if err := checkAndRecordNonce(native, contract, shardID, pubKey, nonce); err != nil {
+		return fmt.Errorf("AttestPeerTransition: %s", err)
+	}
+
+	if err := setShardPeerState(native, contract, shardID, toState, pubKeyHex); err != nil {
+		return fmt.Errorf("AttestPeerTransition: %s", err)
+	}
+
+	return setPeerAttestation(native, contract, shardID, pubKey, &PeerAttestation{
+		Nonce:  nonce,
+		Sig:    sig,
+		Height: native.Height,
+	})
+}
+
+func attestationMessage(shardID types.ShardID, fromState, toState peerState, nonce uint64, contract common.Address) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(shardCoordOf(shardID).Bytes())
+	buf.WriteString(string(fromState))
+	buf.WriteString(string(toState))
+	serialization.WriteUint64(buf, nonce)
+	buf.Write(contract[:])
+	return buf.Bytes()
+}
+
+// GetPeerAttestationParam is the native-method parameter for
+// ShardMgmtGetPeerAttestation.
+type GetPeerAttestationParam struct {
+	ShardID types.ShardID
+	PubKey  string
+}
+
+func (this *GetPeerAttestationParam) Serialize(w io.Writer) error {
+	if err := this.ShardID.Serialize(w); err != nil {
+		return fmt.Errorf("GetPeerAttestationParam.Serialize: shardID: %s", err)
+	}
+	return serialization.WriteString(w, this.PubKey)
+}
+
+func (this *GetPeerAttestationParam) Deserialize(r io.Reader) error {
+	if err := this.ShardID.Deserialize(r); err != nil {
+		return fmt.Errorf("GetPeerAttestationParam.Deserialize: shardID: %s", err)
+	}
+	pubKey, err := serialization.ReadString(r)
+	if err != nil {
+		return fmt.Errorf("GetPeerAttestationParam.Deserialize: pubKey: %s", err)
+	}
+	this.PubKey = pubKey
+	return nil
+}
+
+// ShardMgmtGetPeerAttestation is the native-contract entry point for
+// GetLatestPeerAttestation, so audit tooling can fetch a peer's latest signed
+// attestation over RPC instead of only governance-internal callers within this
+// package being able to see it. It returns an empty result if the peer has never
+// attested, matching how ShardMgmtListPeers/ShardMgmtListShards report "nothing
+// found" (an empty, still well-formed response, not an error).
+func ShardMgmtGetPeerAttestation(native *native.NativeService) ([]byte, error) {
+	param := &GetPeerAttestationParam{}
+	if err := param.Deserialize(bytes.NewBuffer(native.Input)); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtGetPeerAttestation: invalid param: %s", err)
+	}
+
+	pubKeyData, err := hex.DecodeString(param.PubKey)
+	if err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtGetPeerAttestation: decode pub key failed, err: %s", err)
+	}
+	pubKey, err := keypair.DeserializePublicKey(pubKeyData)
+	if err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtGetPeerAttestation: deserialize pub key failed, err: %s", err)
+	}
+
+	contract := native.ContextRef.CurrentContext().ContractAddress
+	attestation, err := GetLatestPeerAttestation(native, contract, param.ShardID, pubKey)
+	if err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtGetPeerAttestation: %s", err)
+	}
+	if attestation == nil {
+		return []byte{}, nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err := attestation.Serialize(buf); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtGetPeerAttestation: serialize attestation: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ShardMgmtAttestPeerTransition is the native-contract entry point for
+// AttestPeerTransition.
+func ShardMgmtAttestPeerTransition(native *native.NativeService) ([]byte, error) {
+	param := &AttestPeerTransitionParam{}
+	if err := param.Deserialize(bytes.NewBuffer(native.Input)); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtAttestPeerTransition: invalid param: %s", err)
+	}
+
+	contract := native.ContextRef.CurrentContext().ContractAddress
+	if err := AttestPeerTransition(native, contract, param.ShardID, peerState(param.FromState), peerState(param.ToState),
+		param.PubKey, param.Nonce, param.Sig); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtAttestPeerTransition: %s", err)
+	}
+	return utils.BYTE_TRUE, nil
+}
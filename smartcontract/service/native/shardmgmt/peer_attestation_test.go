@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2019 The ontology Authors
+ * This file is part of The ontology library.
+ *
+ * The ontology is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The ontology is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The ontology.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package shardmgmt
+
+import "testing"
+
+func TestIsKnownPeerState(t *testing.T) {
+	known := []peerState{state_default, state_applied, state_approved, state_joined, state_throttled}
+	for _, state := range known {
+		if !isKnownPeerState(state) {
+			t.Errorf("expected %s to be a known peer state", state)
+		}
+	}
+	if isKnownPeerState(peerState("whatever-an-attacker-sends")) {
+		t.Errorf("arbitrary strings must not be accepted as a peer state")
+	}
+}
+
+func TestAllowedPeerAttestedTransitionsRejectsSelfPromotion(t *testing.T) {
+	// A peer must not be able to jump straight from default to joined, skipping the
+	// governance apply/approve gate.
+	if allowedPeerAttestedTransitions[state_default] == state_joined {
+		t.Fatalf("default -> joined must not be a peer-attestable transition")
+	}
+	if _, ok := allowedPeerAttestedTransitions[state_applied]; ok {
+		t.Fatalf("applied -> approved is governance's decision, not peer-attestable")
+	}
+}
+
+func TestAllowedPeerAttestedTransitionsPermitsPeerInitiatedLegs(t *testing.T) {
+	cases := []struct {
+		from, to peerState
+	}{
+		{state_default, state_applied},
+		{state_approved, state_joined},
+		{state_joined, state_default},
+	}
+	for _, c := range cases {
+		if allowedPeerAttestedTransitions[c.from] != c.to {
+			t.Errorf("expected %s -> %s to be permitted", c.from, c.to)
+		}
+	}
+}
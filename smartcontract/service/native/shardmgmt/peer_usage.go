@@ -0,0 +1,410 @@
+/*
+ * Copyright (C) 2019 The ontology Authors
+ * This file is part of The ontology library.
+ *
+ * The ontology is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The ontology is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The ontology.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package shardmgmt
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/ontio/ontology-crypto/keypair"
+	"github.com/ontio/ontology/common"
+	"github.com/ontio/ontology/common/serialization"
+	cstates "github.com/ontio/ontology/core/states"
+	"github.com/ontio/ontology/core/types"
+	"github.com/ontio/ontology/smartcontract/service/native"
+	"github.com/ontio/ontology/smartcontract/service/native/utils"
+)
+
+const (
+	KEY_PEER_USAGE     = "peerUsage"
+	KEY_PEER_USAGE_CAP = "peerUsageCap"
+)
+
+// PeerUsageAction is the kind of cross-shard traffic a peer performed, as recorded by
+// RecordPeerUsage.
+type PeerUsageAction string
+
+const (
+	PeerUsagePut PeerUsageAction = "put"
+	PeerUsageGet PeerUsageAction = "get"
+)
+
+// PeerUsage tracks one peer's cross-shard bandwidth and request counts since the
+// last settlement, so the shard's consensus layer can police bandwidth the same
+// way decentralized storage networks police cross-node order/agreement traffic.
+type PeerUsage struct {
+	TotalBytesIn    uint64
+	TotalBytesOut   uint64
+	PutActionCount  uint64
+	GetActionCount  uint64
+	LastResetHeight uint32
+}
+
+func (this *PeerUsage) Serialize(w io.Writer) error {
+	if err := serialization.WriteUint64(w, this.TotalBytesIn); err != nil {
+		return fmt.Errorf("PeerUsage.Serialize: totalBytesIn: %s", err)
+	}
+	if err := serialization.WriteUint64(w, this.TotalBytesOut); err != nil {
+		return fmt.Errorf("PeerUsage.Serialize: totalBytesOut: %s", err)
+	}
+	if err := serialization.WriteUint64(w, this.PutActionCount); err != nil {
+		return fmt.Errorf("PeerUsage.Serialize: putActionCount: %s", err)
+	}
+	if err := serialization.WriteUint64(w, this.GetActionCount); err != nil {
+		return fmt.Errorf("PeerUsage.Serialize: getActionCount: %s", err)
+	}
+	return serialization.WriteUint32(w, this.LastResetHeight)
+}
+
+func (this *PeerUsage) Deserialize(r io.Reader) error {
+	var err error
+	if this.TotalBytesIn, err = serialization.ReadUint64(r); err != nil {
+		return fmt.Errorf("PeerUsage.Deserialize: totalBytesIn: %s", err)
+	}
+	if this.TotalBytesOut, err = serialization.ReadUint64(r); err != nil {
+		return fmt.Errorf("PeerUsage.Deserialize: totalBytesOut: %s", err)
+	}
+	if this.PutActionCount, err = serialization.ReadUint64(r); err != nil {
+		return fmt.Errorf("PeerUsage.Deserialize: putActionCount: %s", err)
+	}
+	if this.GetActionCount, err = serialization.ReadUint64(r); err != nil {
+		return fmt.Errorf("PeerUsage.Deserialize: getActionCount: %s", err)
+	}
+	if this.LastResetHeight, err = serialization.ReadUint32(r); err != nil {
+		return fmt.Errorf("PeerUsage.Deserialize: lastResetHeight: %s", err)
+	}
+	return nil
+}
+
+func genPeerUsageKey(contract common.Address, shardCoordBytes []byte, pubKey keypair.PublicKey) []byte {
+	return utils.ConcatKey(contract, shardCoordBytes, []byte(KEY_PEER_USAGE), keypair.SerializePublicKey(pubKey))
+}
+
+func getPeerUsage(native *native.NativeService, contract common.Address, shardID types.ShardID, pubKey keypair.PublicKey) (*PeerUsage, error) {
+	key := genPeerUsageKey(contract, shardCoordOf(shardID).Bytes(), pubKey)
+	data, err := native.CacheDB.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("getPeerUsage: read db failed, err: %s", err)
+	}
+	if len(data) == 0 {
+		return &PeerUsage{}, nil
+	}
+	value, err := cstates.GetValueFromRawStorageItem(data)
+	if err != nil {
+		return nil, fmt.Errorf("getPeerUsage: deserialize from raw storage: %s", err)
+	}
+	usage := &PeerUsage{}
+	if err := usage.Deserialize(bytes.NewBuffer(value)); err != nil {
+		return nil, fmt.Errorf("getPeerUsage: deserialize PeerUsage: %s", err)
+	}
+	return usage, nil
+}
+
+func setPeerUsage(native *native.NativeService, contract common.Address, shardID types.ShardID, pubKey keypair.PublicKey, usage *PeerUsage) error {
+	buf := new(bytes.Buffer)
+	if err := usage.Serialize(buf); err != nil {
+		return fmt.Errorf("setPeerUsage: serialize PeerUsage: %s", err)
+	}
+	key := genPeerUsageKey(contract, shardCoordOf(shardID).Bytes(), pubKey)
+	native.CacheDB.Put(key, cstates.GenRawStorageItem(buf.Bytes()))
+	return nil
+}
+
+// getPeerUsageCap returns the configured per-peer per-epoch byte cap, or 0 if no cap
+// has been configured (in which case RecordPeerUsage never throttles).
+func getPeerUsageCap(native *native.NativeService, contract common.Address) (uint64, error) {
+	data, err := native.CacheDB.Get(utils.ConcatKey(contract, []byte(KEY_PEER_USAGE_CAP)))
+	if err != nil {
+		return 0, fmt.Errorf("getPeerUsageCap: read db failed, err: %s", err)
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	value, err := cstates.GetValueFromRawStorageItem(data)
+	if err != nil {
+		return 0, fmt.Errorf("getPeerUsageCap: deserialize from raw storage: %s", err)
+	}
+	return serialization.ReadUint64(bytes.NewBuffer(value))
+}
+
+func setPeerUsageCap(native *native.NativeService, contract common.Address, usageCap uint64) error {
+	buf := new(bytes.Buffer)
+	if err := serialization.WriteUint64(buf, usageCap); err != nil {
+		return fmt.Errorf("setPeerUsageCap: serialize cap: %s", err)
+	}
+	native.CacheDB.Put(utils.ConcatKey(contract, []byte(KEY_PEER_USAGE_CAP)), cstates.GenRawStorageItem(buf.Bytes()))
+	return nil
+}
+
+// exceedsCap reports whether usage has gone over usageCap. A cap of 0 means no cap is
+// configured, so usage never exceeds it.
+func exceedsCap(usage *PeerUsage, usageCap uint64) bool {
+	if usageCap == 0 {
+		return false
+	}
+	return usage.TotalBytesIn+usage.TotalBytesOut > usageCap
+}
+
+// RecordPeerUsage is invoked from cross-shard message handlers on every put/get so the
+// peer's running totals stay current. When a configured per-epoch cap is exceeded, the
+// peer is transitioned from state_joined to state_throttled so the shard's consensus
+// layer stops routing traffic to it, and a ShardMgmtEvent is emitted to announce it.
+func RecordPeerUsage(native *native.NativeService, contract common.Address, shardID types.ShardID, pubKeyHex string, action PeerUsageAction, numBytes uint64) error {
+	pubKeyData, err := hex.DecodeString(pubKeyHex)
+	if err != nil {
+		return fmt.Errorf("RecordPeerUsage: decode pub key failed, err: %s", err)
+	}
+	pubKey, err := keypair.DeserializePublicKey(pubKeyData)
+	if err != nil {
+		return fmt.Errorf("RecordPeerUsage: deserialize pub key failed, err: %s", err)
+	}
+
+	usage, err := getPeerUsage(native, contract, shardID, pubKey)
+	if err != nil {
+		return fmt.Errorf("RecordPeerUsage: %s", err)
+	}
+
+	switch action {
+	case PeerUsagePut:
+		usage.TotalBytesOut += numBytes
+		usage.PutActionCount++
+	case PeerUsageGet:
+		usage.TotalBytesIn += numBytes
+		usage.GetActionCount++
+	default:
+		return fmt.Errorf("RecordPeerUsage: unknown action %s", action)
+	}
+
+	if err := setPeerUsage(native, contract, shardID, pubKey, usage); err != nil {
+		return fmt.Errorf("RecordPeerUsage: %s", err)
+	}
+
+	usageCap, err := getPeerUsageCap(native, contract)
+	if err != nil {
+		return fmt.Errorf("RecordPeerUsage: %s", err)
+	}
+	if !exceedsCap(usage, usageCap) {
+		return nil
+	}
+
+	state, err := getShardPeerState(native, contract, shardID, pubKeyHex)
+	if err != nil {
+		return fmt.Errorf("RecordPeerUsage: %s", err)
+	}
+	if state != state_joined {
+		return nil
+	}
+	if err := setShardPeerState(native, contract, shardID, state_throttled, pubKeyHex); err != nil {
+		return fmt.Errorf("RecordPeerUsage: throttle peer: %s", err)
+	}
+	return AddNotification(native, contract, &peerThrottledEvent{shardID: shardID, height: native.Height})
+}
+
+// SettlePeerUsage snapshots the current per-peer counters for shardID into an
+// on-chain settlement record and resets them, starting a new accounting epoch. height
+// must be the current native invocation height; it is taken explicitly (rather than
+// always reading native.Height) so callers settle against the height they intended,
+// and a stale or forged height in the param is rejected instead of silently settling
+// "now".
+func SettlePeerUsage(native *native.NativeService, contract common.Address, shardID types.ShardID, height uint32) error {
+	if height != native.Height {
+		return fmt.Errorf("SettlePeerUsage: height %d does not match current height %d", height, native.Height)
+	}
+
+	peers, err := ListShardPeers(native, contract, shardID)
+	if err != nil {
+		return fmt.Errorf("SettlePeerUsage: %s", err)
+	}
+
+	for _, peer := range peers {
+		usage, err := getPeerUsage(native, contract, shardID, peer.PubKey)
+		if err != nil {
+			return fmt.Errorf("SettlePeerUsage: %s", err)
+		}
+
+		settlementKey := utils.ConcatKey(contract, shardCoordOf(shardID).Bytes(), []byte(KEY_PEER_USAGE), []byte("settlement"),
+			keypair.SerializePublicKey(peer.PubKey))
+		buf := new(bytes.Buffer)
+		if err := serialization.WriteUint32(buf, native.Height); err != nil {
+			return fmt.Errorf("SettlePeerUsage: serialize settlement height: %s", err)
+		}
+		if err := usage.Serialize(buf); err != nil {
+			return fmt.Errorf("SettlePeerUsage: serialize settled usage: %s", err)
+		}
+		native.CacheDB.Put(settlementKey, cstates.GenRawStorageItem(buf.Bytes()))
+
+		if err := setPeerUsage(native, contract, shardID, peer.PubKey, &PeerUsage{LastResetHeight: native.Height}); err != nil {
+			return fmt.Errorf("SettlePeerUsage: reset usage: %s", err)
+		}
+	}
+	return nil
+}
+
+// SetPeerUsageCapParam is the native-method parameter for ShardMgmtSetPeerUsageCap.
+type SetPeerUsageCapParam struct {
+	Cap uint64
+}
+
+func (this *SetPeerUsageCapParam) Serialize(w io.Writer) error {
+	return serialization.WriteUint64(w, this.Cap)
+}
+
+func (this *SetPeerUsageCapParam) Deserialize(r io.Reader) error {
+	capVal, err := serialization.ReadUint64(r)
+	if err != nil {
+		return fmt.Errorf("SetPeerUsageCapParam.Deserialize: cap: %s", err)
+	}
+	this.Cap = capVal
+	return nil
+}
+
+// ShardMgmtSetPeerUsageCap is the governance-only native-contract entry point for
+// configuring the per-peer per-epoch byte cap that RecordPeerUsage enforces. It is
+// gated on checkAdminWitness, so only the configured shard-mgmt admin can change it.
+func ShardMgmtSetPeerUsageCap(native *native.NativeService) ([]byte, error) {
+	param := &SetPeerUsageCapParam{}
+	if err := param.Deserialize(bytes.NewBuffer(native.Input)); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtSetPeerUsageCap: invalid param: %s", err)
+	}
+
+	contract := native.ContextRef.CurrentContext().ContractAddress
+	if err := checkAdminWitness(native, contract); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtSetPeerUsageCap: %s", err)
+	}
+	if err := setPeerUsageCap(native, contract, param.Cap); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtSetPeerUsageCap: %s", err)
+	}
+	return utils.BYTE_TRUE, nil
+}
+
+// SettlePeerUsageParam is the native-method parameter for ShardMgmtSettlePeerUsage.
+type SettlePeerUsageParam struct {
+	ShardID types.ShardID
+	Height  uint32
+}
+
+func (this *SettlePeerUsageParam) Serialize(w io.Writer) error {
+	if err := this.ShardID.Serialize(w); err != nil {
+		return fmt.Errorf("SettlePeerUsageParam.Serialize: shardID: %s", err)
+	}
+	return serialization.WriteUint32(w, this.Height)
+}
+
+func (this *SettlePeerUsageParam) Deserialize(r io.Reader) error {
+	if err := this.ShardID.Deserialize(r); err != nil {
+		return fmt.Errorf("SettlePeerUsageParam.Deserialize: shardID: %s", err)
+	}
+	height, err := serialization.ReadUint32(r)
+	if err != nil {
+		return fmt.Errorf("SettlePeerUsageParam.Deserialize: height: %s", err)
+	}
+	this.Height = height
+	return nil
+}
+
+// ShardMgmtSettlePeerUsage is the governance-only native-contract entry point for
+// SettlePeerUsage. It is gated on checkAdminWitness, so settlement can't be forced by
+// an arbitrary caller.
+func ShardMgmtSettlePeerUsage(native *native.NativeService) ([]byte, error) {
+	param := &SettlePeerUsageParam{}
+	if err := param.Deserialize(bytes.NewBuffer(native.Input)); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtSettlePeerUsage: invalid param: %s", err)
+	}
+
+	contract := native.ContextRef.CurrentContext().ContractAddress
+	if err := checkAdminWitness(native, contract); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtSettlePeerUsage: %s", err)
+	}
+	if err := SettlePeerUsage(native, contract, param.ShardID, param.Height); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtSettlePeerUsage: %s", err)
+	}
+	return utils.BYTE_TRUE, nil
+}
+
+// RecordPeerUsageParam is the native-method parameter for ShardMgmtRecordPeerUsage.
+type RecordPeerUsageParam struct {
+	ShardID  types.ShardID
+	PubKey   string
+	Action   string
+	NumBytes uint64
+}
+
+func (this *RecordPeerUsageParam) Serialize(w io.Writer) error {
+	if err := this.ShardID.Serialize(w); err != nil {
+		return fmt.Errorf("RecordPeerUsageParam.Serialize: shardID: %s", err)
+	}
+	if err := serialization.WriteString(w, this.PubKey); err != nil {
+		return fmt.Errorf("RecordPeerUsageParam.Serialize: pubKey: %s", err)
+	}
+	if err := serialization.WriteString(w, this.Action); err != nil {
+		return fmt.Errorf("RecordPeerUsageParam.Serialize: action: %s", err)
+	}
+	return serialization.WriteUint64(w, this.NumBytes)
+}
+
+func (this *RecordPeerUsageParam) Deserialize(r io.Reader) error {
+	if err := this.ShardID.Deserialize(r); err != nil {
+		return fmt.Errorf("RecordPeerUsageParam.Deserialize: shardID: %s", err)
+	}
+	var err error
+	if this.PubKey, err = serialization.ReadString(r); err != nil {
+		return fmt.Errorf("RecordPeerUsageParam.Deserialize: pubKey: %s", err)
+	}
+	if this.Action, err = serialization.ReadString(r); err != nil {
+		return fmt.Errorf("RecordPeerUsageParam.Deserialize: action: %s", err)
+	}
+	if this.NumBytes, err = serialization.ReadUint64(r); err != nil {
+		return fmt.Errorf("RecordPeerUsageParam.Deserialize: numBytes: %s", err)
+	}
+	return nil
+}
+
+// ShardMgmtRecordPeerUsage is the native-contract entry point for RecordPeerUsage, so
+// cross-shard message handlers have an actual entry point to call into on every
+// put/get instead of RecordPeerUsage only being reachable from within this package.
+func ShardMgmtRecordPeerUsage(native *native.NativeService) ([]byte, error) {
+	param := &RecordPeerUsageParam{}
+	if err := param.Deserialize(bytes.NewBuffer(native.Input)); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtRecordPeerUsage: invalid param: %s", err)
+	}
+
+	contract := native.ContextRef.CurrentContext().ContractAddress
+	if err := RecordPeerUsage(native, contract, param.ShardID, param.PubKey, PeerUsageAction(param.Action), param.NumBytes); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtRecordPeerUsage: %s", err)
+	}
+	return utils.BYTE_TRUE, nil
+}
+
+// peerThrottledEvent implements shardstates.ShardMgmtEvent so consensus can react to a
+// peer being throttled the same way it reacts to any other shard-mgmt state change.
+type peerThrottledEvent struct {
+	shardID types.ShardID
+	height  uint32
+}
+
+func (evt *peerThrottledEvent) GetType() uint32 { return EVENT_SHARD_PEER_THROTTLED }
+func (evt *peerThrottledEvent) GetHeight() uint32 { return evt.height }
+func (evt *peerThrottledEvent) GetTargetShardID() types.ShardID { return evt.shardID }
+
+// EVENT_SHARD_PEER_THROTTLED identifies a peer-throttled audit event in
+// ShardEventState.EventType, alongside EVENT_SHARD_MIGRATE and the other shard-mgmt
+// event types.
+const EVENT_SHARD_PEER_THROTTLED uint32 = 101
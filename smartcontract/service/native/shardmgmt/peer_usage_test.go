@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2019 The ontology Authors
+ * This file is part of The ontology library.
+ *
+ * The ontology is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The ontology is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The ontology.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package shardmgmt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExceedsCapNoCapConfigured(t *testing.T) {
+	usage := &PeerUsage{TotalBytesIn: 1 << 40, TotalBytesOut: 1 << 40}
+	if exceedsCap(usage, 0) {
+		t.Fatalf("a cap of 0 must mean unlimited")
+	}
+}
+
+func TestExceedsCapBelowAndAboveThreshold(t *testing.T) {
+	usage := &PeerUsage{TotalBytesIn: 40, TotalBytesOut: 40}
+	if exceedsCap(usage, 100) {
+		t.Fatalf("80 bytes must not exceed a cap of 100")
+	}
+	if !exceedsCap(usage, 79) {
+		t.Fatalf("80 bytes must exceed a cap of 79")
+	}
+	if exceedsCap(usage, 80) {
+		t.Fatalf("usage exactly at the cap must not be treated as exceeding it")
+	}
+}
+
+func TestPeerUsageSerializeDeserializeRoundTrip(t *testing.T) {
+	usage := &PeerUsage{
+		TotalBytesIn:    123,
+		TotalBytesOut:   456,
+		PutActionCount:  7,
+		GetActionCount:  8,
+		LastResetHeight: 9,
+	}
+
+	buf := new(bytes.Buffer)
+	if err := usage.Serialize(buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	got := &PeerUsage{}
+	if err := got.Deserialize(buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if *got != *usage {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", got, usage)
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright (C) 2019 The ontology Authors
+ * This file is part of The ontology library.
+ *
+ * The ontology is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The ontology is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The ontology.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package shardmgmt
+
+import "testing"
+
+func TestShardCoordBytesRoundTrip(t *testing.T) {
+	coord := NewShardCoord(7, 42)
+	decoded, err := ShardCoordFromBytes(coord.Bytes())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if decoded != coord {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", decoded, coord)
+	}
+}
+
+func TestShardCoordFromBytesRejectsWrongLength(t *testing.T) {
+	if _, err := ShardCoordFromBytes([]byte{1, 2, 3}); err == nil {
+		t.Fatalf("expected error for short input")
+	}
+}
+
+func TestShardCoordLegacyUint64RoundTrip(t *testing.T) {
+	coord := NewShardCoord(3, 99)
+	got := ShardCoordFromLegacyUint64(coord.ToLegacyUint64())
+	if got != coord {
+		t.Fatalf("legacy round trip mismatch: got %+v, want %+v", got, coord)
+	}
+}
+
+func TestShardCoordDistinctAcrossClusters(t *testing.T) {
+	a := NewShardCoord(0, 5)
+	b := NewShardCoord(1, 5)
+	if a.ToLegacyUint64() == b.ToLegacyUint64() {
+		t.Fatalf("coords in different clusters must not collide on the flat legacy ID")
+	}
+}
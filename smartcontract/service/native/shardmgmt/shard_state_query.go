@@ -0,0 +1,175 @@
+/*
+ * Copyright (C) 2019 The ontology Authors
+ * This file is part of The ontology library.
+ *
+ * The ontology is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The ontology is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public License
+ * along with The ontology.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package shardmgmt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ontio/ontology-crypto/keypair"
+	"github.com/ontio/ontology/common"
+	"github.com/ontio/ontology/common/serialization"
+	cstates "github.com/ontio/ontology/core/states"
+	"github.com/ontio/ontology/core/types"
+	"github.com/ontio/ontology/smartcontract/service/native"
+	"github.com/ontio/ontology/smartcontract/service/native/shardmgmt/states"
+	"github.com/ontio/ontology/smartcontract/service/native/utils"
+)
+
+// PeerEntry is one row of a shard's peer membership, as returned by ListShardPeers.
+type PeerEntry struct {
+	PubKey keypair.PublicKey
+	State  peerState
+}
+
+// ListShardPeers enumerates every peer that has ever touched shardID's peer-state
+// namespace, regardless of their current state. Callers that only care about a
+// specific state (e.g. consensus routing, which only wants `state_joined`) should
+// use ListShardPeersByState instead.
+func ListShardPeers(native *native.NativeService, contract common.Address, shardID types.ShardID) ([]*PeerEntry, error) {
+	return ListShardPeersByState(native, contract, shardID, "")
+}
+
+// ListShardPeersByState is the PeerStateFilter variant of ListShardPeers: passing an
+// empty filter returns every peer, otherwise only peers currently in that state are
+// returned. This keeps consensus-layer queries (e.g. "who is joined") cheap, since the
+// filtering happens without a second round trip per peer.
+func ListShardPeersByState(native *native.NativeService, contract common.Address, shardID types.ShardID, filter peerState) ([]*PeerEntry, error) {
+	prefix := utils.ConcatKey(contract, shardCoordOf(shardID).Bytes(), []byte(KEY_SHARD_PEER_STATE))
+	iter := native.CacheDB.NewIterator(prefix)
+	defer iter.Release()
+
+	var peers []*PeerEntry
+	for has := iter.First(); has; has = iter.Next() {
+		pubKeyBytes := iter.Key()[len(prefix):]
+		pubKey, err := keypair.DeserializePublicKey(pubKeyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("ListShardPeersByState: deserialize pub key: %s", err)
+		}
+
+		value, err := cstates.GetValueFromRawStorageItem(iter.Value())
+		if err != nil {
+			return nil, fmt.Errorf("ListShardPeersByState: deserialize raw storage item: %s", err)
+		}
+		state := peerState(value)
+		if filter != "" && state != filter {
+			continue
+		}
+
+		peers = append(peers, &PeerEntry{PubKey: pubKey, State: state})
+	}
+	return peers, nil
+}
+
+// ListShards enumerates every shard that has been created under contract.
+func ListShards(native *native.NativeService, contract common.Address) ([]*shardstates.ShardState, error) {
+	prefix := utils.ConcatKey(contract, []byte(KEY_SHARD_STATE))
+	iter := native.CacheDB.NewIterator(prefix)
+	defer iter.Release()
+
+	var shards []*shardstates.ShardState
+	for has := iter.First(); has; has = iter.Next() {
+		value, err := cstates.GetValueFromRawStorageItem(iter.Value())
+		if err != nil {
+			return nil, fmt.Errorf("ListShards: deserialize raw storage item: %s", err)
+		}
+		state := &shardstates.ShardState{}
+		if err := state.Deserialize(bytes.NewBuffer(value)); err != nil {
+			return nil, fmt.Errorf("ListShards: deserialize ShardState: %s", err)
+		}
+		shards = append(shards, state)
+	}
+	return shards, nil
+}
+
+// ListShardPeersParam is the native-method parameter for ShardMgmtListPeers. An empty
+// PeerStateFilter returns every peer of the shard.
+type ListShardPeersParam struct {
+	ShardID         types.ShardID
+	PeerStateFilter string
+}
+
+func (this *ListShardPeersParam) Serialize(w io.Writer) error {
+	if err := this.ShardID.Serialize(w); err != nil {
+		return fmt.Errorf("ListShardPeersParam.Serialize: shardID: %s", err)
+	}
+	return serialization.WriteString(w, this.PeerStateFilter)
+}
+
+func (this *ListShardPeersParam) Deserialize(r io.Reader) error {
+	if err := this.ShardID.Deserialize(r); err != nil {
+		return fmt.Errorf("ListShardPeersParam.Deserialize: shardID: %s", err)
+	}
+	filter, err := serialization.ReadString(r)
+	if err != nil {
+		return fmt.Errorf("ListShardPeersParam.Deserialize: peerStateFilter: %s", err)
+	}
+	this.PeerStateFilter = filter
+	return nil
+}
+
+// ShardMgmtListPeers is the native-contract entry point for ListShardPeersByState, so
+// RPC clients can inspect shard membership without maintaining an off-chain index.
+func ShardMgmtListPeers(native *native.NativeService) ([]byte, error) {
+	param := &ListShardPeersParam{}
+	if err := param.Deserialize(bytes.NewBuffer(native.Input)); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtListPeers: invalid param: %s", err)
+	}
+
+	contract := native.ContextRef.CurrentContext().ContractAddress
+	peers, err := ListShardPeersByState(native, contract, param.ShardID, peerState(param.PeerStateFilter))
+	if err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtListPeers: %s", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := serialization.WriteUint32(buf, uint32(len(peers))); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtListPeers: serialize count: %s", err)
+	}
+	for _, peer := range peers {
+		if err := serialization.WriteVarBytes(buf, keypair.SerializePublicKey(peer.PubKey)); err != nil {
+			return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtListPeers: serialize pubkey: %s", err)
+		}
+		if err := serialization.WriteString(buf, string(peer.State)); err != nil {
+			return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtListPeers: serialize state: %s", err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// ShardMgmtListShards is the native-contract entry point for ListShards.
+func ShardMgmtListShards(native *native.NativeService) ([]byte, error) {
+	contract := native.ContextRef.CurrentContext().ContractAddress
+	shards, err := ListShards(native, contract)
+	if err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtListShards: %s", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := serialization.WriteUint32(buf, uint32(len(shards))); err != nil {
+		return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtListShards: serialize count: %s", err)
+	}
+	for _, shard := range shards {
+		if err := shard.Serialize(buf); err != nil {
+			return utils.BYTE_FALSE, fmt.Errorf("ShardMgmtListShards: serialize shard: %s", err)
+		}
+	}
+	return buf.Bytes(), nil
+}
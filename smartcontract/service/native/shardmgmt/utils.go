@@ -48,10 +48,11 @@ const (
 type peerState string
 
 const (
-	state_default  peerState = "default"
-	state_applied  peerState = "applied"
-	state_approved peerState = "approved"
-	state_joined   peerState = "joined"
+	state_default   peerState = "default"
+	state_applied   peerState = "applied"
+	state_approved  peerState = "approved"
+	state_joined    peerState = "joined"
+	state_throttled peerState = "throttled"
 )
 
 func genPeerStateKey(contract common.Address, shardIdBytes []byte, pubKey keypair.PublicKey) []byte {
@@ -132,12 +133,7 @@ func setGlobalState(native *native.NativeService, contract common.Address, state
 }
 
 func GetShardState(native *native.NativeService, contract common.Address, shardID types.ShardID) (*shardstates.ShardState, error) {
-	shardIDBytes, err := shardutil.GetUint64Bytes(shardID.ToUint64())
-	if err != nil {
-		return nil, fmt.Errorf("getShardState, serialize shardID: %s", err)
-	}
-
-	shardStateBytes, err := native.CacheDB.Get(utils.ConcatKey(contract, []byte(KEY_SHARD_STATE), shardIDBytes))
+	shardStateBytes, err := native.CacheDB.Get(utils.ConcatKey(contract, []byte(KEY_SHARD_STATE), shardCoordOf(shardID).Bytes()))
 	if err != nil {
 		return nil, fmt.Errorf("getShardState: %s", err)
 	}
@@ -159,10 +155,7 @@ func GetShardState(native *native.NativeService, contract common.Address, shardI
 }
 
 func setShardState(native *native.NativeService, contract common.Address, state *shardstates.ShardState) error {
-	shardIDBytes, err := shardutil.GetUint64Bytes(state.ShardID.ToUint64())
-	if err != nil {
-		return fmt.Errorf("setShardState, serialize shardID: %s", err)
-	}
+	shardIDBytes := shardCoordOf(state.ShardID).Bytes()
 
 	buf := new(bytes.Buffer)
 	if err := state.Serialize(buf); err != nil {
@@ -195,6 +188,12 @@ func AddNotification(native *native.NativeService, contract common.Address, info
 	return nil
 }
 
+// setShardPeerState is the raw storage primitive for a peer-state transition: it does
+// not authenticate the caller itself. Governance-driven transitions (apply review,
+// approve) call it directly, since those are decisions governance makes about a peer,
+// not ones the peer proves consent to. Peer-driven transitions (join confirmation,
+// voluntary leave) must go through AttestPeerTransition instead, which verifies the
+// peer's signature before calling this.
 func setShardPeerState(native *native.NativeService, contract common.Address, shardId types.ShardID, state peerState,
 	pubKey string) error {
 	pubKeyData, err := hex.DecodeString(pubKey)
@@ -205,11 +204,7 @@ func setShardPeerState(native *native.NativeService, contract common.Address, sh
 	if err != nil {
 		return fmt.Errorf("setShardPeerState: deserialize param pub key failed, err: %s", err)
 	}
-	shardIDBytes, err := shardutil.GetUint64Bytes(shardId.ToUint64())
-	if err != nil {
-		return fmt.Errorf("setShardPeerState: serialize shardID: %s", err)
-	}
-	key := genPeerStateKey(contract, shardIDBytes, paramPubkey)
+	key := genPeerStateKey(contract, shardCoordOf(shardId).Bytes(), paramPubkey)
 	native.CacheDB.Put(key, cstates.GenRawStorageItem([]byte(state)))
 	return nil
 }
@@ -224,11 +219,7 @@ func getShardPeerState(native *native.NativeService, contract common.Address, sh
 	if err != nil {
 		return state_default, fmt.Errorf("getShardPeerState: deserialize param pub key failed, err: %s", err)
 	}
-	shardIDBytes, err := shardutil.GetUint64Bytes(shardId.ToUint64())
-	if err != nil {
-		return state_default, fmt.Errorf("getShardPeerState: serialize shardID: %s", err)
-	}
-	key := genPeerStateKey(contract, shardIDBytes, paramPubkey)
+	key := genPeerStateKey(contract, shardCoordOf(shardId).Bytes(), paramPubkey)
 	data, err := native.CacheDB.Get(key)
 	if err != nil {
 		return state_default, fmt.Errorf("getShardPeerState: read db failed, err: %s", err)